@@ -0,0 +1,119 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type batchOp uint8
+
+const (
+	opPut batchOp = iota + 1
+	opDelete
+)
+
+type batchRecord struct {
+	key, val []byte
+	op       batchOp
+}
+
+// Batch is an ordered set of Put/Delete operations to be applied to a Writer
+// as a single unit (see Writer.Write for its crash behavior), modeled on goleveldb's
+// leveldb/batch.Batch.
+//
+// The zero Batch is ready to use.
+type Batch struct {
+	records []batchRecord
+}
+
+// Put appends a Put operation to the batch. The key and val are copied, so
+// the caller's slices may be reused afterwards.
+func (b *Batch) Put(key, val []byte) {
+	b.records = append(b.records, batchRecord{
+		op:  opPut,
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), val...),
+	})
+}
+
+// Delete appends a tombstone for key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.records = append(b.records, batchRecord{
+		op:  opDelete,
+		key: append([]byte(nil), key...),
+	})
+}
+
+// Len returns the number of operations recorded in the batch.
+func (b *Batch) Len() int { return len(b.records) }
+
+// Reset empties the batch, so it can be reused.
+func (b *Batch) Reset() { b.records = b.records[:0] }
+
+// MarshalBinary encodes the batch as a sequence of length-prefixed
+// op-key-val tuples: a one-byte op, a uvarint key length, the key, and -
+// for Put only - a uvarint value length followed by the value.
+func (b *Batch) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	var tmp [binary.MaxVarintLen64]byte
+	for _, r := range b.records {
+		buf.WriteByte(byte(r.op))
+		n := binary.PutUvarint(tmp[:], uint64(len(r.key)))
+		buf.Write(tmp[:n])
+		buf.Write(r.key)
+		if r.op == opPut {
+			n = binary.PutUvarint(tmp[:], uint64(len(r.val)))
+			buf.Write(tmp[:n])
+			buf.Write(r.val)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a batch previously produced by MarshalBinary,
+// replacing the batch's current contents.
+func (b *Batch) UnmarshalBinary(p []byte) error {
+	b.Reset()
+	r := bytes.NewReader(p)
+	for r.Len() > 0 {
+		op, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("read op: %w", err)
+		}
+		key, err := readBytes(r)
+		if err != nil {
+			return fmt.Errorf("read key: %w", err)
+		}
+		switch batchOp(op) {
+		case opPut:
+			val, err := readBytes(r)
+			if err != nil {
+				return fmt.Errorf("read value: %w", err)
+			}
+			b.Put(key, val)
+		case opDelete:
+			b.Delete(key)
+		default:
+			return fmt.Errorf("unknown batch op %d", op)
+		}
+	}
+	return nil
+}
+
+func readBytes(r *bytes.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
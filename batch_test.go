@@ -0,0 +1,94 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/UNO-SOFT/mcdb"
+)
+
+func TestBatchMarshalRoundtrip(t *testing.T) {
+	var b mcdb.Batch
+	b.Put([]byte("a"), []byte("1"))
+	b.Put([]byte("b"), []byte("2"))
+	b.Delete([]byte("a"))
+	if b.Len() != 3 {
+		t.Fatalf("got %d records, wanted 3", b.Len())
+	}
+
+	p, err := b.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got mcdb.Batch
+	if err := got.UnmarshalBinary(p); err != nil {
+		t.Fatal(err)
+	}
+	if got.Len() != b.Len() {
+		t.Fatalf("got %d records after roundtrip, wanted %d", got.Len(), b.Len())
+	}
+
+	q, err := got.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p, q) {
+		t.Errorf("roundtrip mismatch:\n%q\n%q", p, q)
+	}
+}
+
+func TestWriterWrite(t *testing.T) {
+	dn, err := os.MkdirTemp("", "mcdb-test.cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAll(dn)
+
+	cw, err := mcdb.NewWriter(dn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cw.Close()
+
+	var b mcdb.Batch
+	for i := 0; i < 64; i++ {
+		b.Put([]byte{byte(i)}, []byte{byte(i)})
+	}
+	if err := cw.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	b.Reset()
+	b.Put([]byte{0}, []byte("updated"))
+	b.Delete([]byte{1})
+	if err := cw.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rw, err := mcdb.NewReader(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	if got, err := rw.Get([]byte{0}); err != nil || !bytes.Equal(got, []byte("updated")) {
+		t.Errorf("key 0: got %q, %v; wanted %q", got, err, "updated")
+	}
+	if got, err := rw.Get([]byte{1}); err != nil {
+		t.Errorf("key 1: unexpected error %v", err)
+	} else if got != nil {
+		t.Errorf("key 1: got %q, wanted deleted (nil)", got)
+	}
+	if got, err := rw.Get([]byte{2}); err != nil || !bytes.Equal(got, []byte{2}) {
+		t.Errorf("key 2: got %q, %v; wanted %q", got, err, []byte{2})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+// DefaultBloomFPRate is the target false-positive rate used to size a
+// shard's bloom filter sidecar when Config.BloomFPRate is zero.
+const DefaultBloomFPRate = 0.01
+
+// bloomFileSuffix replaces a shard's ".cdb" suffix to name its bloom filter
+// sidecar, e.g. "mcdb-v2-4,001.cdb" -> "mcdb-v2-4,001.bloom".
+const bloomFileSuffix = ".bloom"
+
+// bloomFilter is a standard Kirsch-Mitzenmacher bloom filter: k probe
+// positions per key are derived from two independently-seeded fnv32a
+// hashes, h1+i*h2, rather than computing k separate hash functions.
+type bloomFilter struct {
+	m, k, n      uint64
+	seed1, seed2 uint32
+	bits         []uint64
+}
+
+// newBloomFilter sizes a bloom filter for n keys at the given target
+// false-positive rate, picking m (bits) and k (probes) the standard way:
+// m = ceil(-n*ln(p) / ln(2)^2), k = round(m/n * ln 2).
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = DefaultBloomFPRate
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	if m < 1 {
+		m = 1
+	}
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		m: m, k: k, n: uint64(n),
+		seed1: rand.Uint32(), seed2: rand.Uint32(),
+		bits: make([]uint64, (m+63)/64),
+	}
+}
+
+func bloomHash(seed uint32, key []byte) uint32 {
+	h := fnv.New32a()
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], seed)
+	_, _ = h.Write(b[:])
+	_, _ = h.Write(key)
+	return h.Sum32()
+}
+
+func (b *bloomFilter) positions(key []byte, f func(pos uint64)) {
+	h1 := uint64(bloomHash(b.seed1, key))
+	h2 := uint64(bloomHash(b.seed2, key)) | 1
+	for i := uint64(0); i < b.k; i++ {
+		f((h1 + i*h2) % b.m)
+	}
+}
+
+func (b *bloomFilter) add(key []byte) {
+	b.positions(key, func(pos uint64) {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	})
+}
+
+// mayContain reports whether key might be in the set the filter was built
+// from. A false result is certain; a true result may be a false positive.
+func (b *bloomFilter) mayContain(key []byte) bool {
+	found := true
+	b.positions(key, func(pos uint64) {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+// bloomSidecarPath returns the bloom filter path for a shard file.
+func bloomSidecarPath(cdbPath string) string {
+	return strings.TrimSuffix(cdbPath, ".cdb") + bloomFileSuffix
+}
+
+// writeBloomFile writes b's header (m, k, n, seed1, seed2) followed by its
+// bit array to path. Bloom sidecars are a read optimization, not durability
+// state, so this doesn't bother with the tmp-file-plus-rename dance the cdb
+// shards themselves use - a reader that finds a missing or truncated one
+// just falls back to direct cdb lookups.
+func writeBloomFile(path string, b *bloomFilter) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var hdr [8*3 + 4*2]byte
+	binary.LittleEndian.PutUint64(hdr[0:], b.m)
+	binary.LittleEndian.PutUint64(hdr[8:], b.k)
+	binary.LittleEndian.PutUint64(hdr[16:], b.n)
+	binary.LittleEndian.PutUint32(hdr[24:], b.seed1)
+	binary.LittleEndian.PutUint32(hdr[28:], b.seed2)
+	if _, err := f.Write(hdr[:]); err != nil {
+		return err
+	}
+	body := make([]byte, 8*len(b.bits))
+	for i, w := range b.bits {
+		binary.LittleEndian.PutUint64(body[i*8:], w)
+	}
+	if _, err := f.Write(body); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readBloomFile reads a bloom filter sidecar previously written by
+// writeBloomFile.
+func readBloomFile(path string) (*bloomFilter, error) {
+	p, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) < 32 {
+		return nil, fmt.Errorf("%s: truncated bloom header", path)
+	}
+	b := &bloomFilter{
+		m:     binary.LittleEndian.Uint64(p[0:]),
+		k:     binary.LittleEndian.Uint64(p[8:]),
+		n:     binary.LittleEndian.Uint64(p[16:]),
+		seed1: binary.LittleEndian.Uint32(p[24:]),
+		seed2: binary.LittleEndian.Uint32(p[28:]),
+	}
+	if b.m == 0 || b.k == 0 {
+		return nil, fmt.Errorf("%s: invalid bloom header", path)
+	}
+	want := 32 + 8*int((b.m+63)/64)
+	if len(p) != want {
+		return nil, fmt.Errorf("%s: bloom body size %d, wanted %d", path, len(p)-32, want-32)
+	}
+	body := p[32:]
+	b.bits = make([]uint64, (b.m+63)/64)
+	for i := range b.bits {
+		b.bits[i] = binary.LittleEndian.Uint64(body[i*8:])
+	}
+	return b, nil
+}
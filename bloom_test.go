@@ -0,0 +1,112 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/UNO-SOFT/mcdb"
+)
+
+func TestBloomSidecarHitsAndMisses(t *testing.T) {
+	dn, err := os.MkdirTemp("", "mcdb-test.cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAll(dn)
+
+	cw, err := mcdb.NewWriter(dn, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	present := make([][]byte, 100)
+	for i := range present {
+		present[i] = []byte(fmt.Sprintf("key-%03d", i))
+		if err := cw.Put(present[i], []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	des, err := os.ReadDir(filepath.Join(dn, "gen-000000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sawBloom bool
+	for _, de := range des {
+		if strings.HasSuffix(de.Name(), ".bloom") {
+			sawBloom = true
+		}
+	}
+	if !sawBloom {
+		t.Fatal("no .bloom sidecar written alongside the shards")
+	}
+
+	rw, err := mcdb.NewReader(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+
+	for _, k := range present {
+		if got, err := rw.Get(k); err != nil || !bytes.Equal(got, []byte("v")) {
+			t.Errorf("%s: got %q, %v; wanted v", k, got, err)
+		}
+	}
+	if got, err := rw.Get([]byte("absent-key")); err != nil || got != nil {
+		t.Errorf("absent-key: got %q, %v; wanted nil", got, err)
+	}
+}
+
+func TestBloomSidecarToleratesCorruption(t *testing.T) {
+	dn, err := os.MkdirTemp("", "mcdb-test.cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAll(dn)
+
+	cw, err := mcdb.NewWriter(dn, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Put([]byte("a"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	genDir := filepath.Join(dn, "gen-000000")
+	_ = os.Chmod(genDir, 0750)
+	des, err := os.ReadDir(genDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, de := range des {
+		if strings.HasSuffix(de.Name(), ".bloom") {
+			p := filepath.Join(genDir, de.Name())
+			_ = os.Chmod(p, 0640)
+			if err := os.WriteFile(p, []byte("garbage"), 0640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	rw, err := mcdb.NewReader(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	if got, err := rw.Get([]byte("a")); err != nil || !bytes.Equal(got, []byte("1")) {
+		t.Fatalf("got %q, %v; wanted 1 despite corrupt bloom sidecar", got, err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionType selects the per-value compression a Writer applies before
+// handing values to the underlying cdb.Writer. It is also the one-byte
+// marker written in front of every value in a version 2+ mcdb directory, so
+// Reader.Get and Iterator.Value can tell how to decode it without any extra
+// metadata.
+type CompressionType uint8
+
+const (
+	// CompressionNone stores values as-is, just prefixed with the marker byte.
+	CompressionNone CompressionType = iota
+	// CompressionSnappy compresses values with github.com/golang/snappy.
+	CompressionSnappy
+	// CompressionZstd compresses values with github.com/klauspost/compress/zstd.
+	CompressionZstd
+)
+
+// DefaultMinCompressSize is the value size below which Config.MinCompressSize
+// defaults to leaving values uncompressed, even when a Compression is set -
+// framing overhead and compression headers make it not worth it.
+const DefaultMinCompressSize = 256
+
+// Config holds the per-value compression settings a Writer applies. The zero
+// Config stores values uncompressed (but still, from version 2 onwards,
+// framed with the CompressionNone marker byte).
+type Config struct {
+	// Compression selects the codec applied to values at least MinCompressSize
+	// bytes long. CompressionNone (the zero value) disables compression.
+	Compression CompressionType
+	// MinCompressSize is the minimum value size that gets compressed; smaller
+	// values are stored as-is. Zero means DefaultMinCompressSize.
+	MinCompressSize int
+
+	// BloomFPRate is the target false-positive rate of the per-shard bloom
+	// filter sidecar a Writer builds alongside each shard. Zero means
+	// DefaultBloomFPRate. Ignored if DisableBloom is set.
+	BloomFPRate float64
+	// DisableBloom turns off building the bloom filter sidecar entirely.
+	DisableBloom bool
+}
+
+func (c Config) minCompressSize() int {
+	if c.MinCompressSize > 0 {
+		return c.MinCompressSize
+	}
+	return DefaultMinCompressSize
+}
+
+// encodeValue prefixes val with its one-byte compression marker, compressing
+// it first if cfg calls for it and val is long enough to bother.
+func encodeValue(cfg Config, val []byte) ([]byte, error) {
+	if cfg.Compression == CompressionNone || len(val) < cfg.minCompressSize() {
+		out := make([]byte, 1+len(val))
+		out[0] = byte(CompressionNone)
+		copy(out[1:], val)
+		return out, nil
+	}
+	switch cfg.Compression {
+	case CompressionSnappy:
+		out := snappy.Encode(nil, val)
+		return append([]byte{byte(CompressionSnappy)}, out...), nil
+	case CompressionZstd:
+		enc, err := sharedZstdEncoder()
+		if err != nil {
+			return nil, err
+		}
+		out := enc.EncodeAll(val, []byte{byte(CompressionZstd)})
+		return out, nil
+	default:
+		return nil, fmt.Errorf("mcdb: unknown Compression %d", cfg.Compression)
+	}
+}
+
+// decodeValue strips the one-byte compression marker a version 2+ mcdb
+// writes in front of every value, decompressing the payload if needed.
+func decodeValue(v []byte) ([]byte, error) {
+	if len(v) == 0 {
+		return v, nil
+	}
+	marker, payload := CompressionType(v[0]), v[1:]
+	switch marker {
+	case CompressionNone:
+		return payload, nil
+	case CompressionSnappy:
+		return decompressSnappy(payload)
+	case CompressionZstd:
+		return decompressZstd(payload)
+	default:
+		return nil, fmt.Errorf("mcdb: unknown compression marker %d", marker)
+	}
+}
+
+// decodeBufPool holds scratch buffers used while decompressing, so repeated
+// Get/Iterator.Value calls on the hot path don't each grow their own buffer
+// from scratch.
+var decodeBufPool = sync.Pool{New: func() interface{} { b := make([]byte, 0, 4096); return &b }}
+
+func decompressSnappy(p []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(p)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+	bufp := decodeBufPool.Get().(*[]byte)
+	defer decodeBufPool.Put(bufp)
+	if cap(*bufp) < n {
+		*bufp = make([]byte, n)
+	}
+	dst, err := snappy.Decode((*bufp)[:n], p)
+	if err != nil {
+		return nil, fmt.Errorf("snappy: %w", err)
+	}
+	out := make([]byte, len(dst))
+	copy(out, dst)
+	return out, nil
+}
+
+func decompressZstd(p []byte) ([]byte, error) {
+	dec, err := sharedZstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	bufp := decodeBufPool.Get().(*[]byte)
+	defer decodeBufPool.Put(bufp)
+	dst, err := dec.DecodeAll(p, (*bufp)[:0])
+	if err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	out := make([]byte, len(dst))
+	copy(out, dst)
+	*bufp = dst
+	return out, nil
+}
+
+var (
+	zstdEncOnce sync.Once
+	zstdEnc     *zstd.Encoder
+	zstdEncErr  error
+
+	zstdDecOnce sync.Once
+	zstdDec     *zstd.Decoder
+	zstdDecErr  error
+)
+
+// sharedZstdEncoder and sharedZstdDecoder are lazily built once and reused:
+// both types are safe for concurrent use via their *All methods, and
+// creation is comparatively expensive.
+func sharedZstdEncoder() (*zstd.Encoder, error) {
+	zstdEncOnce.Do(func() { zstdEnc, zstdEncErr = zstd.NewWriter(nil) })
+	return zstdEnc, zstdEncErr
+}
+
+func sharedZstdDecoder() (*zstd.Decoder, error) {
+	zstdDecOnce.Do(func() { zstdDec, zstdDecErr = zstd.NewReader(nil) })
+	return zstdDec, zstdDecErr
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/UNO-SOFT/mcdb"
+)
+
+func TestCompression(t *testing.T) {
+	big := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), 64)
+	small := []byte("tiny")
+
+	tests := []struct {
+		name string
+		comp mcdb.CompressionType
+	}{
+		{"snappy", mcdb.CompressionSnappy},
+		{"zstd", mcdb.CompressionZstd},
+	}
+	for _, tt := range tests {
+		comp := tt.comp
+		t.Run(tt.name, func(t *testing.T) {
+			dn, err := os.MkdirTemp("", "mcdb-test.cdb")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer removeAll(dn)
+
+			cw, err := mcdb.NewWriter(dn, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cw.Config.Compression = comp
+			if err := cw.Put([]byte("big"), big); err != nil {
+				t.Fatal(err)
+			}
+			if err := cw.Put([]byte("small"), small); err != nil {
+				t.Fatal(err)
+			}
+			if err := cw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			rw, err := mcdb.NewReader(dn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rw.Close()
+
+			if got, err := rw.Get([]byte("big")); err != nil || !bytes.Equal(got, big) {
+				t.Errorf("big: got %d bytes, err %v; wanted %d bytes", len(got), err, len(big))
+			}
+			if got, err := rw.Get([]byte("small")); err != nil || !bytes.Equal(got, small) {
+				t.Errorf("small: got %q, err %v; wanted %q", got, err, small)
+			}
+		})
+	}
+}
@@ -0,0 +1,332 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/colinmarc/cdb"
+	"golang.org/x/exp/mmap"
+)
+
+// genDirPattern names a generation directory, analogous to LevelDB numbering
+// its manifest/SSTable files.
+const genDirPattern = "gen-%06d"
+
+// currentFileName is the CURRENT pointer file, analogous to LevelDB's
+// CURRENT file: it holds the name of the generation directory that is
+// presently live.
+const currentFileName = "CURRENT"
+
+func generationDir(root string, gen uint64) string {
+	return filepath.Join(root, fmt.Sprintf(genDirPattern, gen))
+}
+
+var errNoCurrent = errors.New("mcdb: no CURRENT file")
+
+// readCurrent reads root's CURRENT file and returns the directory the
+// generation it names lives in, and that generation's number.
+func readCurrent(root string) (dir string, gen uint64, err error) {
+	p, err := os.ReadFile(filepath.Join(root, currentFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", 0, errNoCurrent
+		}
+		return "", 0, err
+	}
+	name := strings.TrimSpace(string(p))
+	if _, err := fmt.Sscanf(name, genDirPattern, &gen); err != nil {
+		return "", 0, fmt.Errorf("%s: malformed CURRENT content %q: %w", root, name, err)
+	}
+	return filepath.Join(root, name), gen, nil
+}
+
+// nextGeneration returns the generation number to use for a new writer
+// rooted at dir: one more than the highest gen-NNNNNN directory already
+// present, or 0 if dir holds none yet. It looks at the directories
+// themselves rather than CURRENT, so a Writer that is still being built (and
+// so hasn't published CURRENT) never collides with one of its own
+// in-progress generations, e.g. while growing.
+func nextGeneration(dir string) (uint64, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var max uint64
+	var found bool
+	for _, de := range des {
+		if !de.IsDir() {
+			continue
+		}
+		var n uint64
+		if _, err := fmt.Sscanf(de.Name(), genDirPattern, &n); err != nil {
+			continue
+		}
+		if !found || n > max {
+			max, found = n, true
+		}
+	}
+	if !found {
+		return 0, nil
+	}
+	return max + 1, nil
+}
+
+// publish atomically rewrites root's CURRENT file to point at gen, fsyncing
+// both the new CURRENT file and root itself so the pointer update survives a
+// crash, analogous to LevelDB's manifest + CURRENT commit.
+func publish(root string, gen uint64) error {
+	tmp := filepath.Join(root, currentFileName+".tmp")
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf(genDirPattern+"\n", gen)), 0640); err != nil {
+		return err
+	}
+	if err := fsyncPath(tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(root, currentFileName)); err != nil {
+		return err
+	}
+	return fsyncPath(root)
+}
+
+// generation is one immutable, fully-readable set of mmap'd shards.
+type generation struct {
+	dir                 string
+	rs                  []*cdb.CDB
+	bucketHash, cdbHash HashFunc
+	expC                int
+	num                 uint64
+	// framed is true for version 2+ directories, where every value is
+	// prefixed with a one-byte CompressionType marker (see compress.go).
+	framed bool
+	// blooms holds one bloom filter per shard, parallel to rs, so Get can
+	// skip a miss without touching the shard's mmap'd pages (see bloom.go).
+	// A nil entry means shard i has no usable bloom sidecar - either
+	// Config.DisableBloom was set when it was written, or the sidecar is
+	// missing or corrupt - and Get falls back to a direct cdb lookup.
+	blooms []*bloomFilter
+}
+
+func (g *generation) close() error {
+	var firstErr error
+	for _, r := range g.rs {
+		if r != nil {
+			if err := r.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// openGeneration mmaps every shard of the mcdb directory dir (which may be a
+// gen-NNNNNN directory or, for pre-generation/legacy directories, the root
+// itself) and is the shared implementation behind NewReader and Refresh.
+func openGeneration(dir string) (*generation, error) {
+	g := &generation{dir: dir, expC: 32}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var version Version
+	for _, de := range des {
+		nm := de.Name()
+		if !(strings.HasPrefix(nm, "mcdb-") && strings.HasSuffix(nm, ".cdb")) {
+			continue
+		}
+		var u1, u2 uint32
+		var v Version
+		var err error
+		if strings.HasPrefix(nm, "mcdb-v") {
+			_, err = fmt.Sscanf(nm, FileName, &v, &u1, &u2)
+		} else {
+			_, err = fmt.Sscanf(nm, FileNameV0, &u1, &u2)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", nm, err)
+		}
+		if g.rs == nil {
+			g.rs = make([]*cdb.CDB, int(u1))
+			g.blooms = make([]*bloomFilter, int(u1))
+			for i := 1; i < len(g.rs); i <<= 1 {
+				g.expC--
+			}
+			version = v
+			switch version {
+			case 0:
+				g.bucketHash, g.cdbHash = fnvHash, fnvHash
+			case 1:
+				g.bucketHash, g.cdbHash = fnvHash, nil
+			case 2:
+				g.bucketHash, g.cdbHash = fnvHash, nil
+				g.framed = true
+			default:
+				return nil, fmt.Errorf("Unknown version %d", version)
+			}
+		} else if version != v {
+			return nil, fmt.Errorf("Version mismatch: was %d, now %d (%q)", version, v, nm)
+		}
+		if u1 != uint32(len(g.rs)) {
+			_ = g.close()
+			return nil, fmt.Errorf("%s: first number should be the same for all files", nm)
+		}
+		if u1 < u2 {
+			_ = g.close()
+			return nil, fmt.Errorf("%s: second number should not be bigger than the second", nm)
+		}
+		fh, err := mmap.Open(filepath.Join(dir, nm))
+		if err != nil {
+			_ = g.close()
+			return nil, err
+		}
+		if g.rs[int(u2)], err = cdb.New(fh, g.cdbHash); err != nil {
+			_ = g.close()
+			return nil, err
+		}
+		// A missing or corrupt bloom sidecar just means Get falls back to a
+		// direct cdb lookup for this shard.
+		if bf, err := readBloomFile(bloomSidecarPath(filepath.Join(dir, nm))); err == nil {
+			g.blooms[int(u2)] = bf
+		}
+	}
+	if len(g.rs) == 0 {
+		return nil, errors.New("no " + FileName + " files found")
+	}
+	for i, r := range g.rs {
+		if r == nil {
+			_ = g.close()
+			return nil, fmt.Errorf(FileName+" not found", version, len(g.rs), i)
+		}
+	}
+	return g, nil
+}
+
+// numShards returns the number of shards in the Reader's current generation.
+func (m *Reader) numShards() int {
+	return len(m.sg.Load().gen.rs)
+}
+
+// sharedGeneration is a generation plus the count of live holders pointing
+// at it, so that Refresh can move a Reader onto a newer generation while
+// whatever still holds a reference to this one - the Reader itself, and any
+// Get or Iter call presently in flight against it, via acquireRef - keeps
+// its mmap'd shards valid. Without a ref held for the duration of each
+// Get/Iter, a concurrent Refresh (e.g. from RW's background compaction)
+// could drop the Reader's own reference and munmap the shards out from
+// under a read that already has a pointer to this generation.
+type sharedGeneration struct {
+	gen    *generation
+	refs   int
+	closed bool
+}
+
+// acquireRef adds one more reference to sg, to be dropped with
+// releaseGeneration once the caller is done reading from sg.gen, and reports
+// whether it succeeded. It fails if sg has already been released down to
+// zero refs and closed - a Reader must reload the current sharedGeneration
+// and retry in that case, rather than resurrecting a generation whose shards
+// have already been munmapped. Unlike acquireGeneration, this never
+// registers or closes a generation - it's for a caller that already holds
+// (or has just loaded) sg and needs to keep it alive a little longer, such
+// as Reader.Get or Reader.Iter.
+func (sg *sharedGeneration) acquireRef() bool {
+	genRegistryMu.Lock()
+	defer genRegistryMu.Unlock()
+	if sg.closed {
+		return false
+	}
+	sg.refs++
+	return true
+}
+
+var (
+	genRegistryMu sync.Mutex
+	genRegistry   = map[string]*sharedGeneration{}
+)
+
+// acquireGeneration registers fresh as the shared generation for dir,
+// sharing with (and closing fresh in favor of) whatever is already
+// registered there.
+func acquireGeneration(dir string, fresh *generation) *sharedGeneration {
+	genRegistryMu.Lock()
+	defer genRegistryMu.Unlock()
+	if sg, ok := genRegistry[dir]; ok {
+		sg.refs++
+		_ = fresh.close()
+		return sg
+	}
+	sg := &sharedGeneration{gen: fresh, refs: 1}
+	genRegistry[dir] = sg
+	return sg
+}
+
+// releaseGeneration drops one reference to sg, closing and unregistering its
+// generation once no Reader holds it any longer.
+func releaseGeneration(sg *sharedGeneration) {
+	genRegistryMu.Lock()
+	defer genRegistryMu.Unlock()
+	sg.refs--
+	if sg.refs <= 0 {
+		sg.closed = true
+		delete(genRegistry, sg.gen.dir)
+		_ = sg.gen.close()
+	}
+}
+
+// PruneOldGenerations removes generation directories under dir beyond the
+// keep most recent ones (by generation number). Generations still
+// referenced by a live Reader (one that hasn't called Refresh past them yet)
+// are left alone even if they fall outside keep.
+func PruneOldGenerations(dir string, keep int) error {
+	if keep < 1 {
+		keep = 1
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var nums []uint64
+	for _, de := range des {
+		if !de.IsDir() {
+			continue
+		}
+		var n uint64
+		if _, err := fmt.Sscanf(de.Name(), genDirPattern, &n); err != nil {
+			continue
+		}
+		nums = append(nums, n)
+	}
+	if len(nums) <= keep {
+		return nil
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] > nums[j] })
+
+	genRegistryMu.Lock()
+	defer genRegistryMu.Unlock()
+	var firstErr error
+	for _, n := range nums[keep:] {
+		gd := generationDir(dir, n)
+		if sg, ok := genRegistry[gd]; ok && sg.refs > 0 {
+			continue
+		}
+		// Writer.Close leaves the directory read-only (0550), which would
+		// keep RemoveAll from unlinking its shards.
+		_ = os.Chmod(gd, 0750)
+		if err := os.RemoveAll(gd); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,77 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/UNO-SOFT/mcdb"
+)
+
+func TestGenerationPublishAndRefresh(t *testing.T) {
+	dn, err := os.MkdirTemp("", "mcdb-test.cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeAll(dn)
+
+	writeGen := func(key, val byte) {
+		cw, err := mcdb.NewWriter(dn, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Put([]byte{key}, []byte{val}); err != nil {
+			t.Fatal(err)
+		}
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeGen(1, 1)
+
+	rw, err := mcdb.NewReader(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	if got, err := rw.Get([]byte{1}); err != nil || !bytes.Equal(got, []byte{1}) {
+		t.Fatalf("got %q, %v; wanted {1}", got, err)
+	}
+
+	writeGen(1, 2)
+	if got, err := rw.Get([]byte{1}); err != nil || !bytes.Equal(got, []byte{1}) {
+		t.Errorf("before Refresh: got %q, %v; wanted stale {1}", got, err)
+	}
+
+	if err := rw.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rw.Get([]byte{1}); err != nil || !bytes.Equal(got, []byte{2}) {
+		t.Errorf("after Refresh: got %q, %v; wanted {2}", got, err)
+	}
+
+	if err := mcdb.PruneOldGenerations(dn, 1); err != nil {
+		t.Fatal(err)
+	}
+	des, err := os.ReadDir(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var genDirs int
+	for _, de := range des {
+		if de.IsDir() {
+			genDirs++
+		}
+	}
+	if genDirs != 1 {
+		t.Errorf("got %d generation directories after prune, wanted 1", genDirs)
+	}
+	if _, err := os.ReadFile(filepath.Join(dn, "CURRENT")); err != nil {
+		t.Errorf("CURRENT missing after prune: %v", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"errors"
 	"fmt"
 	"strconv"
+	"sync/atomic"
 
 	//"log"
 	"hash"
@@ -51,12 +52,30 @@ func bucket(h HashFunc, key []byte, expC int) int {
 }
 
 // Writer is the writer. It needs the number of tables beforehand.
+//
+// Writer builds its shards into a fresh generation directory (gen-NNNNNN)
+// under root, and only makes them visible to readers when Close publishes
+// that generation by atomically rewriting root's CURRENT file - see
+// NewReader and Reader.Refresh.
 type Writer struct {
 	ws         []cdbWriter
+	root       string
 	path       string
 	bucketHash HashFunc
 	expC       int
+	gen        uint64
 	canGrow    bool
+
+	// keys holds, per bucket, every key Put into it so far, so closeFiles
+	// can build that shard's bloom filter sidecar (see bloom.go). Buckets
+	// finalized through Write build their own sidecar in
+	// bucketBuild.writeBloom instead, and Write clears their entry here.
+	keys [][][]byte
+
+	// Config controls per-value compression; set it right after NewWriter,
+	// before the first Put/Write/Load call. The zero Config stores values
+	// uncompressed.
+	Config Config
 }
 
 type cdbWriter struct {
@@ -82,10 +101,16 @@ func NewWriter(dir string, n int) (*Writer, error) {
 	for n2 = 1; n2 < n; n2 <<= 1 {
 		expC--
 	}
+	gen, err := nextGeneration(dir)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	genDir := generationDir(dir, gen)
 	m := Writer{
-		expC: expC, canGrow: canGrow, path: dir,
+		expC: expC, canGrow: canGrow, root: dir, path: genDir, gen: gen,
 		bucketHash: fnvHash,
 		ws:         make([]cdbWriter, n2),
+		keys:       make([][][]byte, n2),
 	}
 	//log.Println("n:", n, "expC:", expC)
 
@@ -93,17 +118,17 @@ func NewWriter(dir string, n int) (*Writer, error) {
 	if i := strings.Index(pat, ",%b."); i >= 0 {
 		pat = pat[:i+2] + "0" + strconv.Itoa(32-m.expC+1) + pat[i+2:]
 	}
-	base := filepath.Join(dir, pat)
-	_ = os.MkdirAll(dir, 0750)
-	_ = os.Chmod(dir, 0750)
+	base := filepath.Join(genDir, pat)
+	_ = os.MkdirAll(genDir, 0750)
+	_ = os.Chmod(genDir, 0750)
 	for i := range m.ws {
 		fh, err := os.Create(fmt.Sprintf(base, DefaultVersion, n2, i))
 		if err != nil {
-			_ = m.Close()
+			_ = m.closeFiles()
 			return nil, err
 		}
 		if m.ws[i].Writer, err = cdb.NewWriter(fh, nil); err != nil {
-			_ = m.Close()
+			_ = m.closeFiles()
 			return nil, err
 		}
 		m.ws[i].fileName = fh.Name()
@@ -111,11 +136,22 @@ func NewWriter(dir string, n int) (*Writer, error) {
 	return &m, nil
 }
 
-// Close the underlying writers.
+// Close the underlying writers and atomically publish this generation by
+// rewriting root's CURRENT file to point at it.
 func (m *Writer) Close() error {
 	if m == nil || len(m.ws) == 0 {
 		return nil
 	}
+	if err := m.closeFiles(); err != nil {
+		return err
+	}
+	return publish(m.root, m.gen)
+}
+
+// closeFiles closes the underlying shard writers and locks the generation
+// directory down to read-only, without publishing it - used both by Close
+// and to clean up a generation that NewWriter failed to fully build.
+func (m *Writer) closeFiles() error {
 	ws := m.ws
 	m.ws = nil
 	for _, w := range ws {
@@ -123,6 +159,18 @@ func (m *Writer) Close() error {
 			_ = w.Close()
 		}
 	}
+	for i, w := range ws {
+		if w.fileName == "" || m.Config.DisableBloom || i >= len(m.keys) || len(m.keys[i]) == 0 {
+			continue
+		}
+		bf := newBloomFilter(len(m.keys[i]), m.Config.BloomFPRate)
+		for _, k := range m.keys[i] {
+			bf.add(k)
+		}
+		if err := writeBloomFile(bloomSidecarPath(w.fileName), bf); err != nil {
+			return fmt.Errorf("write bloom for %q: %w", w.fileName, err)
+		}
+	}
 	if fi, err := os.Stat(m.path); err != nil {
 		return err
 	} else if fi.Mode().IsDir() {
@@ -147,12 +195,29 @@ func (m *Writer) Close() error {
 //
 // When growing, the number of tables doubles, and all data is copied.
 func (m *Writer) Put(key, val []byte) error {
-	err := m.ws[bucket(m.bucketHash, key, m.expC)].Put(key, val)
-	if err == nil || !m.canGrow || !errors.Is(err, cdb.ErrTooMuchData) {
+	i := bucket(m.bucketHash, key, m.expC)
+	if m.ws[i].Writer == nil {
+		return fmt.Errorf("bucket %d already finalized by Write; mixing Put and Write on the same Writer is not supported", i)
+	}
+	encoded, err := encodeValue(m.Config, val)
+	if err != nil {
 		return err
 	}
+	err = m.ws[i].Put(key, encoded)
+	if err != nil {
+		if !m.canGrow || !errors.Is(err, cdb.ErrTooMuchData) {
+			return err
+		}
+	} else {
+		if !m.Config.DisableBloom {
+			m.keys[i] = append(m.keys[i], append([]byte(nil), key...))
+		}
+		return nil
+	}
 
-	// Grow by copying the old to 2x tables.
+	// Grow by copying the old to 2x tables, in a brand new (as yet
+	// unpublished) generation - the old, still-unpublished one is simply
+	// abandoned, so no reader of the published generation is ever affected.
 	for _, w := range m.ws {
 		if err := w.Close(); err != nil {
 			return err
@@ -163,11 +228,12 @@ func (m *Writer) Put(key, val []byte) error {
 		return fmt.Errorf("read %q: %w", m.path, err)
 	}
 	defer r.Close()
-	m2, err := NewWriter(m.path, 2*len(m.ws))
+	m2, err := NewWriter(m.root, 2*len(m.ws))
 	if err != nil {
-		return fmt.Errorf("create (%d) %q: %w", 2*len(m.ws), m.path, err)
+		return fmt.Errorf("create (%d) %q: %w", 2*len(m.ws), m.root, err)
 	}
 	m2.canGrow = true
+	m2.Config = m.Config
 
 	if err := m2.Put(key, val); err != nil {
 		return fmt.Errorf("put %q: %w", key, err)
@@ -184,101 +250,106 @@ func (m *Writer) Put(key, val []byte) error {
 	for _, w := range m.ws {
 		_ = os.Remove(w.fileName)
 	}
-	m.Close()
+	_ = os.Remove(m.path)
+	m.ws = nil
 	*m = *m2
 	return nil
 }
 
 // Reader is a reader for multiple CDB files.
+//
+// A Reader opened against a directory of numbered generations (see Writer)
+// points at a single sharedGeneration at a time; call Refresh to move it
+// onto whatever generation CURRENT names next, without invalidating byte
+// slices returned by Get/Iter on the generation it was pointing at before.
 type Reader struct {
-	rs                  []*cdb.CDB
-	bucketHash, cdbHash HashFunc
-	expC                int
+	root string
+	sg   atomic.Pointer[sharedGeneration]
 }
 
 type Version uint8
 
 func (v Version) String() string { return fmt.Sprintf("v%d", v) }
 
-const DefaultVersion = Version(1)
+// DefaultVersion is the mcdb file format version new Writers write.
+// Version 2 prefixes every value with a one-byte CompressionType marker (see
+// Config); version 1 and version 0 directories remain readable as-is.
+const DefaultVersion = Version(2)
 
 // NewReader opens the multiple CDB files for reading.
+//
+// If dir has a CURRENT file (see Writer.Close), the generation it names is
+// opened. Otherwise dir is treated as a flat, pre-generation mcdb directory,
+// for backwards compatibility with databases written before generations
+// were introduced.
 func NewReader(dir string) (*Reader, error) {
-	m := Reader{expC: 32}
-	des, err := os.ReadDir(dir)
-	if err != nil && len(des) == 0 {
+	if fi, err := os.Stat(dir); err == nil && !fi.IsDir() {
 		// Hack for one-file "multicdb"
-		if fh, err := mmap.Open(dir); err == nil {
-			if rs, err := cdb.New(fh, nil); err == nil {
-				m.rs = append(m.rs[:0], rs)
-				return &m, nil
-			}
-		}
-		return nil, err
-	}
-	var version Version
-	for _, de := range des {
-		nm := de.Name()
-		if !(strings.HasPrefix(nm, "mcdb-") && strings.HasSuffix(nm, ".cdb")) {
-			continue
-		}
-		var u1, u2 uint32
-		var v Version
-		var err error
-		if strings.HasPrefix(nm, "mcdb-v") {
-			_, err = fmt.Sscanf(de.Name(), FileName, &v, &u1, &u2)
-		} else {
-			_, err = fmt.Sscanf(de.Name(), FileNameV0, &u1, &u2)
-		}
+		fh, err := mmap.Open(dir)
 		if err != nil {
-			return nil, fmt.Errorf("%s: %w", de.Name(), err)
-		}
-		if m.rs == nil {
-			m.rs = make([]*cdb.CDB, int(u1))
-			for i := 1; i < len(m.rs); i <<= 1 {
-				m.expC--
-			}
-			version = v
-			switch version {
-			case 0:
-				m.bucketHash, m.cdbHash = fnvHash, fnvHash
-			case 1:
-				m.bucketHash, m.cdbHash = fnvHash, nil
-			default:
-				return nil, fmt.Errorf("Unknown version %d", version)
-			}
-		} else if version != v {
-			return nil, fmt.Errorf("Version mismatch: was %d, now %d (%q)", version, v, de.Name())
-		}
-		if u1 != uint32(len(m.rs)) {
-			_ = m.Close()
-			return nil, fmt.Errorf("%s: first number should be the same for all files", de.Name())
-		}
-		if u1 < u2 {
-			_ = m.Close()
-			return nil, fmt.Errorf("%s: second number should not be bigger than the second", de.Name())
+			return nil, err
 		}
-		fh, err := mmap.Open(filepath.Join(dir, de.Name()))
+		rs, err := cdb.New(fh, nil)
 		if err != nil {
-			_ = m.Close()
+			_ = fh.Close()
 			return nil, err
 		}
-		if m.rs[int(u2)], err = cdb.New(fh, m.cdbHash); err != nil {
-			_ = m.Close()
+		g := &generation{dir: dir, expC: 32, bucketHash: fnvHash, rs: []*cdb.CDB{rs}}
+		m := Reader{}
+		m.sg.Store(acquireGeneration(dir, g))
+		return &m, nil
+	}
+
+	genDir, gen, err := readCurrent(dir)
+	if err != nil {
+		if !errors.Is(err, errNoCurrent) {
 			return nil, err
 		}
+		genDir, gen = dir, 0 // legacy, pre-generation flat layout
 	}
-	if len(m.rs) == 0 {
-		return nil, errors.New("no " + FileName + " files found")
+	g, err := openGeneration(genDir)
+	if err != nil {
+		return nil, err
 	}
-	for i, r := range m.rs {
-		if r == nil {
-			_ = m.Close()
-			return nil, fmt.Errorf(FileName+" not found", version, len(m.rs), i)
+	g.num = gen
+	m := Reader{root: dir}
+	m.sg.Store(acquireGeneration(genDir, g))
+	return &m, nil
+}
+
+// Refresh re-reads dir's CURRENT file and, if it now names a newer
+// generation than the Reader currently points at, swaps the Reader onto it.
+// The previous generation's mmap'd shards - and any byte slice Get or Iter
+// returned from them - stay valid until every Reader pointing at that
+// generation has refreshed past it or been closed.
+//
+// Refresh is a no-op for Readers opened on a flat, pre-generation directory
+// or a single-file multicdb, since those have no CURRENT to follow.
+func (m *Reader) Refresh() error {
+	if m == nil || m.root == "" {
+		return nil
+	}
+	genDir, gen, err := readCurrent(m.root)
+	if err != nil {
+		if errors.Is(err, errNoCurrent) {
+			return nil // legacy, pre-generation flat layout: nothing to refresh onto
 		}
+		return err
 	}
-	//log.Println("rs:", len(m.rs), "expC:", m.expC, "version:", version, "bucketHash:", m.bucketHash, "cdbHash:", m.cdbHash)
-	return &m, nil
+	old := m.sg.Load()
+	if old != nil && old.gen.num == gen {
+		return nil
+	}
+	g, err := openGeneration(genDir)
+	if err != nil {
+		return err
+	}
+	g.num = gen
+	m.sg.Store(acquireGeneration(genDir, g))
+	if old != nil {
+		releaseGeneration(old)
+	}
+	return nil
 }
 
 const (
@@ -288,30 +359,71 @@ const (
 
 // Close the underlying readers.
 func (m *Reader) Close() error {
-	rs := m.rs
-	m.rs = nil
-	if rs == nil {
+	sg := m.sg.Swap(nil)
+	if sg == nil {
 		return nil
 	}
-	for _, r := range rs {
-		if r != nil {
-			_ = r.Close()
-		}
-	}
+	releaseGeneration(sg)
 	return nil
 }
 
 // Get returns the value for a given key, or nil if it can't be found.
+//
+// Get holds a reference to the generation it reads from for the duration of
+// the call, so a concurrent Refresh on the same Reader can't munmap its
+// shards out from under it. Loading m.sg and acquiring that reference isn't
+// one atomic step, so if a Refresh closes the loaded generation in that
+// window, acquireRef fails and Get reloads m.sg (by then pointing at
+// whatever Refresh swapped in) and retries, rather than reviving a
+// generation whose shards have already been munmapped.
 func (m *Reader) Get(key []byte) ([]byte, error) {
-	return m.rs[bucket(m.bucketHash, key, m.expC)].Get(key)
+	var sg *sharedGeneration
+	for {
+		sg = m.sg.Load()
+		if sg.acquireRef() {
+			break
+		}
+	}
+	defer releaseGeneration(sg)
+	g := sg.gen
+	i := bucket(g.bucketHash, key, g.expC)
+	if g.blooms != nil {
+		if bf := g.blooms[i]; bf != nil && !bf.mayContain(key) {
+			return nil, nil
+		}
+	}
+	v, err := g.rs[i].Get(key)
+	if err != nil || v == nil || !g.framed {
+		return v, err
+	}
+	return decodeValue(v)
 }
 
 // Iter returns an iterator.
+//
+// The returned Iterator holds a reference to the generation it reads from,
+// acquired here and released once Next returns false or Err reports an
+// error, so a concurrent Refresh on the same Reader can't munmap its shards
+// while the iteration is in progress. Callers must drain the Iterator (call
+// Next until it returns false) to release that reference. As in Get, a
+// failed acquireRef means a concurrent Refresh closed the loaded generation
+// first, so Iter reloads m.sg and retries rather than iterating a closed
+// generation.
 func (m *Reader) Iter() *Iterator {
-	if m == nil || len(m.rs) == 0 {
+	if m == nil {
 		return nil
 	}
-	return &Iterator{m: m, it: m.rs[0].Iter()}
+	var sg *sharedGeneration
+	for {
+		sg = m.sg.Load()
+		if sg == nil || len(sg.gen.rs) == 0 {
+			return nil
+		}
+		if sg.acquireRef() {
+			break
+		}
+	}
+	return &Iterator{sg: sg, g: sg.gen, it: sg.gen.rs[0].Iter()}
 }
 
 // Dump all the underlying data in cdbmake format ("+%d,%d:%s->%s\n", len(key), len(value), key, value)
@@ -339,19 +451,44 @@ func (m *Reader) DumpContext(ctx context.Context, w io.Writer) error {
 
 // Iterator iterates through all keys of all CDB files.
 type Iterator struct {
-	m  *Reader
+	sg *sharedGeneration
+	g  *generation
 	it *cdb.Iterator
 	i  int
 }
 
+// release drops the Iterator's reference to its generation, acquired by
+// Reader.Iter. It's idempotent: once called, m.sg is cleared so a second
+// call (or none at all, if the caller abandons the Iterator) is safe.
+func (m *Iterator) release() {
+	if m.sg == nil {
+		return
+	}
+	sg := m.sg
+	m.sg = nil
+	releaseGeneration(sg)
+}
+
 // Err returns the last error.
 func (m *Iterator) Err() error { return m.it.Err() }
 
 // Key returns the current key (after Next).
 func (m *Iterator) Key() []byte { return m.it.Key() }
 
-// Value returns the current value (after Next).
-func (m *Iterator) Value() []byte { return m.it.Value() }
+// Value returns the current value (after Next), transparently decompressing
+// it if the underlying generation stores compressed values. If the stored
+// value is corrupt and can't be decoded, Value returns nil.
+func (m *Iterator) Value() []byte {
+	v := m.it.Value()
+	if !m.g.framed {
+		return v
+	}
+	dv, err := decodeValue(v)
+	if err != nil {
+		return nil
+	}
+	return dv
+}
 
 // Next advances the iterator, if possible.
 //
@@ -362,13 +499,14 @@ func (m *Iterator) Next() bool {
 	if m.it.Next() {
 		return true
 	}
-	for m.i < len(m.m.rs)-1 {
+	for m.i < len(m.g.rs)-1 {
 		m.i++
-		m.it = m.m.rs[m.i].Iter()
+		m.it = m.g.rs[m.i].Iter()
 		if m.it.Next() {
 			return true
 		}
 	}
+	m.release()
 	return false
 }
 
@@ -410,6 +548,20 @@ func (m *Writer) Load(r io.Reader) error {
 }
 
 // LoadContext the Writer from cdbmake format ("+%d,%d:%s->%s\n", len(key), len(value), key, value).
+//
+// LoadContext streams records straight into the Writer via Put, same as
+// before Write existed, and is deliberately scoped out of Write's
+// crash-safety: Write rebuilds a whole bucket's shard from its existing
+// contents on every call, so driving a bulk load through it in batches would
+// make loading N records copy each shard back out roughly N/batchSize times
+// - quadratic in the number of records. A load interrupted partway through
+// LoadContext therefore leaves the Writer with only the records Put before
+// the interruption, not the all-or-nothing guarantee Write gives a Batch.
+// Callers that need a crash-safe load should build their own Batch and call
+// Write directly, accepting Write's per-call shard-rebuild cost for however
+// many records they batch at a time; LoadContext itself favors the
+// streaming loader's linear cost, as befits the library's primary ingest
+// path for data volumes too large for that rebuild cost to be worthwhile.
 func (m *Writer) LoadContext(ctx context.Context, r io.Reader) error {
 	br := bufio.NewReaderSize(r, 1<<20)
 	var key, val []byte
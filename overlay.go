@@ -0,0 +1,483 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// walFileName is the append-only log RW uses to survive a crash between
+// Commit calls, analogous to LevelDB's memtable log.
+const walFileName = "WAL"
+
+// DefaultFlushThreshold is the overlay size, in bytes, past which Put and
+// Delete trigger a background compaction if RW.FlushThreshold is unset.
+const DefaultFlushThreshold = 4 << 20
+
+type overlayVal struct {
+	val     []byte
+	deleted bool
+}
+
+// RW is a mutable handle on an mcdb directory: an immutable Reader over the
+// current generation plus an in-memory overlay of Put/Delete operations not
+// yet folded into a generation, modeled on LevelDB's memtable-over-SSTable
+// design. Get and Iter consult the overlay first, falling back to the
+// underlying generation; once the overlay grows past FlushThreshold (or
+// Flush is called explicitly) it is compacted into a fresh generation in the
+// background and CURRENT is republished.
+//
+// Puts and Deletes are visible to Get/Iter immediately, but only survive a
+// crash once Commit has fsynced them to the WAL, or a compaction has folded
+// them into a published generation.
+type RW struct {
+	root string
+	r    *Reader
+
+	mu          sync.Mutex
+	overlay     map[string]*overlayVal
+	overlaySize int
+	pending     Batch
+	wal         *os.File
+	walPath     string
+
+	compactMu sync.Mutex
+
+	// Config controls the compression used when the overlay is compacted
+	// into a new generation; see Writer.Config.
+	Config Config
+	// FlushThreshold is the overlay size, in bytes, past which Put and
+	// Delete trigger a background compaction. Zero means
+	// DefaultFlushThreshold.
+	FlushThreshold int
+}
+
+// OpenRW opens dir - creating an empty generation in it first if it's
+// missing or empty - as a mutable RW handle.
+func OpenRW(dir string) (*RW, error) {
+	empty, err := isEmptyOrMissingDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if empty {
+		w, err := NewWriter(dir, 2)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap %q: %w", dir, err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("bootstrap %q: %w", dir, err)
+		}
+	}
+	r, err := NewReader(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := &RW{
+		root:    dir,
+		r:       r,
+		overlay: make(map[string]*overlayVal),
+		walPath: filepath.Join(dir, walFileName),
+	}
+	if err := rw.replayWAL(); err != nil {
+		_ = r.Close()
+		return nil, fmt.Errorf("replay %q: %w", rw.walPath, err)
+	}
+	f, err := os.OpenFile(rw.walPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		_ = r.Close()
+		return nil, err
+	}
+	rw.wal = f
+	return rw, nil
+}
+
+func isEmptyOrMissingDir(dir string) (bool, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	return len(des) == 0, nil
+}
+
+// replayWAL reads every Commit-ed batch from the WAL file, if any, and
+// applies it to the overlay - recovering writes that were committed but not
+// yet folded into a generation when the process last exited.
+func (rw *RW) replayWAL() error {
+	p, err := os.ReadFile(rw.walPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	br := bytes.NewReader(p)
+	for br.Len() > 0 {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return err
+		}
+		var b Batch
+		if err := b.UnmarshalBinary(buf); err != nil {
+			return err
+		}
+		for i := range b.records {
+			rw.applyLocked(b.records[i].op, b.records[i].key, b.records[i].val)
+		}
+	}
+	return nil
+}
+
+// applyLocked updates the overlay and its size accounting for one op. The
+// caller must hold rw.mu.
+func (rw *RW) applyLocked(op batchOp, key, val []byte) {
+	k := string(key)
+	if old, ok := rw.overlay[k]; ok {
+		rw.overlaySize -= len(k)
+		if !old.deleted {
+			rw.overlaySize -= len(old.val)
+		}
+	}
+	if op == opDelete {
+		rw.overlay[k] = &overlayVal{deleted: true}
+		rw.overlaySize += len(k)
+		return
+	}
+	v := append([]byte(nil), val...)
+	rw.overlay[k] = &overlayVal{val: v}
+	rw.overlaySize += len(k) + len(v)
+}
+
+// Get returns the value for key, consulting the overlay before falling back
+// to the underlying generation, or nil if the key doesn't exist or was
+// deleted.
+func (rw *RW) Get(key []byte) ([]byte, error) {
+	rw.mu.Lock()
+	v, ok := rw.overlay[string(key)]
+	rw.mu.Unlock()
+	if ok {
+		if v.deleted {
+			return nil, nil
+		}
+		return append([]byte(nil), v.val...), nil
+	}
+	return rw.r.Get(key)
+}
+
+// Put records key=val in the overlay, visible to Get/Iter immediately. It
+// isn't durable until Commit or a compaction runs.
+func (rw *RW) Put(key, val []byte) error {
+	rw.mu.Lock()
+	rw.applyLocked(opPut, key, val)
+	rw.pending.Put(key, val)
+	rw.mu.Unlock()
+	rw.maybeCompactAsync()
+	return nil
+}
+
+// Delete records a tombstone for key in the overlay, visible to Get/Iter
+// immediately. It isn't durable until Commit or a compaction runs.
+func (rw *RW) Delete(key []byte) error {
+	rw.mu.Lock()
+	rw.applyLocked(opDelete, key, nil)
+	rw.pending.Delete(key)
+	rw.mu.Unlock()
+	rw.maybeCompactAsync()
+	return nil
+}
+
+// Commit fsyncs every Put/Delete recorded since the last Commit to the WAL,
+// so they survive a crash even before the next compaction.
+func (rw *RW) Commit() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.pending.Len() == 0 {
+		return nil
+	}
+	p, err := rw.pending.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(p)))
+	if _, err := rw.wal.Write(tmp[:n]); err != nil {
+		return err
+	}
+	if _, err := rw.wal.Write(p); err != nil {
+		return err
+	}
+	if err := rw.wal.Sync(); err != nil {
+		return err
+	}
+	rw.pending.Reset()
+	return nil
+}
+
+func (rw *RW) flushThreshold() int {
+	if rw.FlushThreshold > 0 {
+		return rw.FlushThreshold
+	}
+	return DefaultFlushThreshold
+}
+
+// maybeCompactAsync starts a background compaction if the overlay has grown
+// past flushThreshold and one isn't already running.
+func (rw *RW) maybeCompactAsync() {
+	rw.mu.Lock()
+	exceeded := rw.overlaySize >= rw.flushThreshold()
+	rw.mu.Unlock()
+	if !exceeded || !rw.compactMu.TryLock() {
+		return
+	}
+	go func() {
+		defer rw.compactMu.Unlock()
+		_ = rw.compact()
+	}()
+}
+
+// Flush compacts the overlay into a fresh generation synchronously, even if
+// it is below FlushThreshold. It is a no-op if the overlay is empty.
+func (rw *RW) Flush() error {
+	rw.compactMu.Lock()
+	defer rw.compactMu.Unlock()
+	return rw.compact()
+}
+
+// compact folds the current overlay into a new generation built from the
+// underlying generation plus the overlay's Put/Delete operations, publishes
+// it, refreshes the Reader onto it, and resets the WAL. The caller must hold
+// compactMu.
+func (rw *RW) compact() error {
+	rw.mu.Lock()
+	if len(rw.overlay) == 0 {
+		rw.mu.Unlock()
+		return nil
+	}
+	ops := make(map[string]*overlayVal, len(rw.overlay))
+	for k, v := range rw.overlay {
+		ops[k] = v
+	}
+	rw.mu.Unlock()
+
+	nw, err := NewWriter(rw.root, -rw.r.numShards())
+	if err != nil {
+		return fmt.Errorf("compact %q: %w", rw.root, err)
+	}
+	nw.Config = rw.Config
+
+	seen := make(map[string]bool, len(ops))
+	it := rw.r.Iter()
+	for it.Next() {
+		k := string(it.Key())
+		if v, ok := ops[k]; ok {
+			seen[k] = true
+			if v.deleted {
+				continue
+			}
+			if err := nw.Put(it.Key(), v.val); err != nil {
+				return fmt.Errorf("compact put %q: %w", k, err)
+			}
+			continue
+		}
+		if err := nw.Put(it.Key(), it.Value()); err != nil {
+			return fmt.Errorf("compact copy %q: %w", k, err)
+		}
+	}
+	if err := it.Err(); err != nil {
+		return fmt.Errorf("compact iterate: %w", err)
+	}
+	for k, v := range ops {
+		if seen[k] || v.deleted {
+			continue
+		}
+		if err := nw.Put([]byte(k), v.val); err != nil {
+			return fmt.Errorf("compact put %q: %w", k, err)
+		}
+	}
+	if err := nw.Close(); err != nil {
+		return fmt.Errorf("compact close: %w", err)
+	}
+	if err := rw.r.Refresh(); err != nil {
+		return fmt.Errorf("compact refresh: %w", err)
+	}
+
+	rw.mu.Lock()
+	for k, v := range ops {
+		if cur, ok := rw.overlay[k]; ok && cur == v {
+			delete(rw.overlay, k)
+		}
+	}
+	var size int
+	for k, v := range rw.overlay {
+		size += len(k)
+		if !v.deleted {
+			size += len(v.val)
+		}
+	}
+	rw.overlaySize = size
+	err = rw.resetWALLocked()
+	rw.mu.Unlock()
+	return err
+}
+
+// resetWALLocked rewrites the WAL to hold exactly what's left in rw.overlay,
+// rather than truncating it to empty. Anything compact folded into the
+// published generation was removed from rw.overlay just above, under the
+// same rw.mu critical section, so this can't race a concurrent Put/Delete or
+// Commit: whatever they add to rw.overlay after this point lands in the new
+// WAL too, or else hasn't happened yet and will reach the WAL through the
+// next Commit as usual. Without this, a Put committed to the old WAL after
+// compact took its overlay snapshot but before the WAL was reset would be
+// fsynced, report success, and then be silently discarded by the truncation,
+// even though it was never folded into the new generation. The caller must
+// hold rw.mu.
+func (rw *RW) resetWALLocked() error {
+	var b Batch
+	for k, v := range rw.overlay {
+		if v.deleted {
+			b.Delete([]byte(k))
+		} else {
+			b.Put([]byte(k), v.val)
+		}
+	}
+	p, err := b.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if rw.wal != nil {
+		_ = rw.wal.Close()
+	}
+	f, err := os.OpenFile(rw.walPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	rw.wal = f
+	if len(p) > 0 {
+		var tmp [binary.MaxVarintLen64]byte
+		n := binary.PutUvarint(tmp[:], uint64(len(p)))
+		if _, err := rw.wal.Write(tmp[:n]); err != nil {
+			return err
+		}
+		if _, err := rw.wal.Write(p); err != nil {
+			return err
+		}
+		if err := rw.wal.Sync(); err != nil {
+			return err
+		}
+	}
+	rw.pending.Reset()
+	return fsyncPath(rw.root)
+}
+
+// Close releases the WAL and underlying Reader. Uncommitted Puts/Deletes are
+// lost.
+//
+// Close takes compactMu first, so it waits out any compaction that
+// maybeCompactAsync started in the background rather than tearing down the
+// WAL and Reader out from under it - compact reads both via rw.r and would
+// otherwise panic on a nil generation once Close has run.
+func (rw *RW) Close() error {
+	rw.compactMu.Lock()
+	defer rw.compactMu.Unlock()
+	rw.mu.Lock()
+	if rw.wal != nil {
+		_ = rw.wal.Close()
+		rw.wal = nil
+	}
+	rw.mu.Unlock()
+	return rw.r.Close()
+}
+
+// RWIterator iterates the merged view of an RW's overlay and underlying
+// generation, skipping deleted keys.
+type RWIterator struct {
+	base     *Iterator
+	overlay  []string
+	snapshot map[string]*overlayVal
+	seen     map[string]bool
+	oi       int
+	key, val []byte
+	err      error
+}
+
+// Iter returns an iterator over the merged overlay+generation view.
+func (rw *RW) Iter() *RWIterator {
+	rw.mu.Lock()
+	snapshot := make(map[string]*overlayVal, len(rw.overlay))
+	keys := make([]string, 0, len(rw.overlay))
+	for k, v := range rw.overlay {
+		snapshot[k] = v
+		keys = append(keys, k)
+	}
+	rw.mu.Unlock()
+	return &RWIterator{
+		base:     rw.r.Iter(),
+		overlay:  keys,
+		snapshot: snapshot,
+		seen:     make(map[string]bool, len(snapshot)),
+	}
+}
+
+// Err returns the last error.
+func (it *RWIterator) Err() error { return it.err }
+
+// Key returns the current key (after Next).
+func (it *RWIterator) Key() []byte { return it.key }
+
+// Value returns the current value (after Next).
+func (it *RWIterator) Value() []byte { return it.val }
+
+// Next advances the iterator, if possible, first through the underlying
+// generation (overridden/skipped per the overlay), then through any
+// overlay-only keys.
+func (it *RWIterator) Next() bool {
+	for it.base != nil && it.base.Next() {
+		k := string(it.base.Key())
+		if v, ok := it.snapshot[k]; ok {
+			it.seen[k] = true
+			if v.deleted {
+				continue
+			}
+			it.key, it.val = it.base.Key(), v.val
+			return true
+		}
+		it.key, it.val = it.base.Key(), it.base.Value()
+		return true
+	}
+	if it.base != nil {
+		if err := it.base.Err(); err != nil {
+			it.err = err
+			return false
+		}
+		it.base = nil
+	}
+	for it.oi < len(it.overlay) {
+		k := it.overlay[it.oi]
+		it.oi++
+		if it.seen[k] {
+			continue
+		}
+		v := it.snapshot[k]
+		if v.deleted {
+			continue
+		}
+		it.key, it.val = []byte(k), v.val
+		return true
+	}
+	return false
+}
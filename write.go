@@ -0,0 +1,210 @@
+// Copyright 2024 Tamás Gulácsi. All rights reserved.
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mcdb
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/colinmarc/cdb"
+	"golang.org/x/exp/mmap"
+)
+
+// Write applies a Batch to the Writer as a single, crash-safe unit, modeled
+// on LevelDB's two-phase manifest commit.
+//
+// Write first builds, for every bucket the batch touches, a sibling
+// "<shard>.cdb.tmp" file holding the existing shard's records (if the shard
+// already exists and is a valid, closed cdb file) merged with the batch's
+// Put/Delete operations - a Delete simply omits the key from the rebuilt
+// shard - and fsyncs it. Only once every touched bucket's tmp file is built
+// and fsynced does Write rename any of them into place, and once every
+// rename is done the directory itself is fsynced. A crash before all tmp
+// files are built leaves every shard in its previous state; a crash after
+// every rename leaves every shard in its new state. The renames are done one
+// file at a time, so a crash between two of them leaves some touched shards
+// in their new state and the others in their previous one. Readers see none
+// of this until Close publishes the Writer's generation through CURRENT.
+//
+// Write finalizes every bucket it touches: afterwards the bucket's file is a
+// complete, closed cdb file, so further Put calls on this Writer for the
+// same bucket return an error. Write does not grow the Writer; a bucket that
+// would overflow cdb's 4GiB limit returns cdb.ErrTooMuchData, same as Put.
+//
+// Write rebuilds a touched bucket's shard from its existing contents on
+// every call, so it is the right primitive for an occasional crash-safe
+// update of a bounded changeset, not for driving a bulk load in batches -
+// see LoadContext, which trades Write's atomicity for linear cost over a
+// whole load instead.
+func (m *Writer) Write(b *Batch) error {
+	if b == nil || b.Len() == 0 {
+		return nil
+	}
+	byBucket := make(map[int][]*batchRecord)
+	for i := range b.records {
+		r := &b.records[i]
+		bi := bucket(m.bucketHash, r.key, m.expC)
+		byBucket[bi] = append(byBucket[bi], r)
+	}
+
+	builds := make([]*bucketBuild, 0, len(byBucket))
+	for bi, recs := range byBucket {
+		bb, err := m.buildBucket(bi, recs)
+		if err != nil {
+			for _, bb := range builds {
+				_ = os.Remove(bb.tmpName)
+			}
+			return fmt.Errorf("build bucket %d: %w", bi, err)
+		}
+		builds = append(builds, bb)
+	}
+	for _, bb := range builds {
+		if err := os.Rename(bb.tmpName, bb.fileName); err != nil {
+			return fmt.Errorf("rename %q to %q: %w", bb.tmpName, bb.fileName, err)
+		}
+	}
+	for _, bb := range builds {
+		if err := bb.writeBloom(m.Config); err != nil {
+			return err
+		}
+	}
+	return fsyncPath(m.path)
+}
+
+// bucketBuild is one bucket's rebuilt-and-fsynced-but-not-yet-renamed tmp
+// file, the result of the first phase of Write's two-phase commit.
+type bucketBuild struct {
+	fileName string
+	tmpName  string
+	keys     [][]byte
+}
+
+// buildBucket rebuilds bucket i's shard into a fresh, fsynced "*.cdb.tmp"
+// file incorporating recs, without touching the live shard file.
+func (m *Writer) buildBucket(i int, recs []*batchRecord) (*bucketBuild, error) {
+	w := &m.ws[i]
+	fileName := w.fileName
+	if w.Writer != nil {
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("close %q: %w", fileName, err)
+		}
+		w.Writer = nil
+	}
+	// The rebuilt shard gets its bloom sidecar from writeBloom, which covers
+	// every key in it; closeFiles must not overwrite that with one built from
+	// only the keys Put into this bucket before.
+	if i < len(m.keys) {
+		m.keys[i] = nil
+	}
+
+	// Last op for a key wins; order is preserved for the first appearance
+	// so pre-existing keys that aren't touched keep their shard order.
+	overlay := make(map[string]*batchRecord, len(recs))
+	order := make([]string, 0, len(recs))
+	for _, r := range recs {
+		k := string(r.key)
+		if _, ok := overlay[k]; !ok {
+			order = append(order, k)
+		}
+		overlay[k] = r
+	}
+
+	tmpName := fileName + ".tmp"
+	tfh, err := os.Create(tmpName)
+	if err != nil {
+		return nil, err
+	}
+	tw, err := cdb.NewWriter(tfh, nil)
+	if err != nil {
+		_ = tfh.Close()
+		_ = os.Remove(tmpName)
+		return nil, err
+	}
+
+	var keys [][]byte
+	if fh, oerr := mmap.Open(fileName); oerr == nil {
+		if old, cerr := cdb.New(fh, nil); cerr == nil {
+			it := old.Iter()
+			for it.Next() {
+				if _, overridden := overlay[string(it.Key())]; overridden {
+					continue
+				}
+				if err := tw.Put(it.Key(), it.Value()); err != nil {
+					_ = fh.Close()
+					_ = tfh.Close()
+					_ = os.Remove(tmpName)
+					return nil, fmt.Errorf("copy %q: %w", it.Key(), err)
+				}
+				keys = append(keys, append([]byte(nil), it.Key()...))
+			}
+			if err := it.Err(); err != nil {
+				_ = fh.Close()
+				_ = tfh.Close()
+				_ = os.Remove(tmpName)
+				return nil, fmt.Errorf("iterate %q: %w", fileName, err)
+			}
+		}
+		_ = fh.Close()
+	}
+
+	for _, k := range order {
+		r := overlay[k]
+		if r.op != opPut {
+			continue
+		}
+		encoded, err := encodeValue(m.Config, r.val)
+		if err != nil {
+			_ = tfh.Close()
+			_ = os.Remove(tmpName)
+			return nil, fmt.Errorf("encode %q: %w", r.key, err)
+		}
+		if err := tw.Put(r.key, encoded); err != nil {
+			_ = tfh.Close()
+			_ = os.Remove(tmpName)
+			return nil, fmt.Errorf("put %q: %w", r.key, err)
+		}
+		keys = append(keys, r.key)
+	}
+
+	if err := tw.Close(); err != nil {
+		_ = os.Remove(tmpName)
+		return nil, fmt.Errorf("close %q: %w", tmpName, err)
+	}
+	if err := fsyncPath(tmpName); err != nil {
+		_ = os.Remove(tmpName)
+		return nil, err
+	}
+	return &bucketBuild{fileName: fileName, tmpName: tmpName, keys: keys}, nil
+}
+
+// writeBloom builds and writes the bloom filter sidecar for a bucket once
+// its tmp file has been renamed into place.
+func (bb *bucketBuild) writeBloom(cfg Config) error {
+	if cfg.DisableBloom || len(bb.keys) == 0 {
+		return nil
+	}
+	bf := newBloomFilter(len(bb.keys), cfg.BloomFPRate)
+	for _, k := range bb.keys {
+		bf.add(k)
+	}
+	if err := writeBloomFile(bloomSidecarPath(bb.fileName), bf); err != nil {
+		return fmt.Errorf("write bloom for %q: %w", bb.fileName, err)
+	}
+	return nil
+}
+
+// fsyncPath opens path (file or directory) and fsyncs it, so that a rename
+// into (or within) it is durable before the caller proceeds.
+func fsyncPath(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = fh.Sync()
+	if cerr := fh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}